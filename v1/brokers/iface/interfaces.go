@@ -0,0 +1,30 @@
+package iface
+
+import (
+	"context"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/tasks"
+)
+
+// Broker is a common interface all brokers implement
+type Broker interface {
+	GetConfig() *config.Config
+	SetRegisteredTaskNames(names []string)
+	IsTaskRegistered(name string) bool
+	StartConsuming(consumerTag string, concurrency int, p TaskProcessor) (bool, error)
+	StopConsuming()
+	Publish(ctx context.Context, task *tasks.Signature) error
+	AdjustRoutingKey(s *tasks.Signature)
+
+	// CancelTask asks whichever broker instance is currently processing
+	// taskUUID to stop, by cancelling the context passed to that task's
+	// TaskProcessor.Process call
+	CancelTask(ctx context.Context, taskUUID string) error
+}
+
+// TaskProcessor can process a delivered task. This will normally be backed
+// by a *worker.Worker instance.
+type TaskProcessor interface {
+	Process(ctx context.Context, signature *tasks.Signature) error
+}
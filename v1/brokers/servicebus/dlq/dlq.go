@@ -0,0 +1,193 @@
+// Package dlq lets operators inspect and recover the messages that
+// brokers/servicebus dead-letters when it receives malformed or
+// unregistered tasks, without reaching for external tooling.
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/RichardKnop/machinery/v1/tasks"
+)
+
+// DeadLetteredTask is a single message found on a queue's $DeadLetterQueue
+// sub-queue, decoded back into its original task signature
+type DeadLetteredTask struct {
+	Signature                  *tasks.Signature
+	DeadLetterReason           string
+	DeadLetterErrorDescription string
+
+	message *azservicebus.ReceivedMessage
+}
+
+// dlqReceiver is the subset of *azservicebus.Receiver the DLQManager needs,
+// narrowed so tests can exercise Peek/Replay/Purge against a fake
+type dlqReceiver interface {
+	PeekMessages(ctx context.Context, maxMessageCount int, options *azservicebus.PeekMessagesOptions) ([]*azservicebus.ReceivedMessage, error)
+	ReceiveMessages(ctx context.Context, maxMessageCount int, options *azservicebus.ReceiveMessagesOptions) ([]*azservicebus.ReceivedMessage, error)
+	CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error
+	AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error
+}
+
+// dlqSender is the subset of *azservicebus.Sender Replay needs
+type dlqSender interface {
+	SendMessage(ctx context.Context, message *azservicebus.Message, options *azservicebus.SendMessageOptions) error
+}
+
+// DLQManager inspects and replays the dead-lettered messages of a single
+// Service Bus queue
+type DLQManager struct {
+	queue    string
+	receiver dlqReceiver
+	sender   dlqSender
+}
+
+// New opens queueName's $DeadLetterQueue sub-queue for inspection and
+// replay
+func New(client *azservicebus.Client, queueName string) (*DLQManager, error) {
+	receiver, err := client.NewReceiverForQueue(queueName, &azservicebus.ReceiverOptions{
+		SubQueue: azservicebus.SubQueueDeadLetter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := client.NewSender(queueName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DLQManager{queue: queueName, receiver: receiver, sender: sender}, nil
+}
+
+// Peek returns up to max dead-lettered tasks without removing them from the
+// dead-letter sub-queue
+func (m *DLQManager) Peek(ctx context.Context, max int) ([]DeadLetteredTask, error) {
+	messages, err := m.receiver.PeekMessages(ctx, max, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]DeadLetteredTask, 0, len(messages))
+	for _, msg := range messages {
+		dlt, err := decode(msg)
+		if err != nil {
+			continue
+		}
+		out = append(out, dlt)
+	}
+	return out, nil
+}
+
+// Replay republishes the dead-lettered task identified by uuid to its
+// original queue and completes its dead-letter copy
+func (m *DLQManager) Replay(ctx context.Context, uuid string) error {
+	dlt, err := m.find(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if dlt == nil {
+		return fmt.Errorf("dead-lettered task %s not found", uuid)
+	}
+
+	msg := &azservicebus.Message{
+		Body:                  dlt.message.Body,
+		MessageID:             &dlt.message.MessageID,
+		SessionID:             dlt.message.SessionID,
+		ApplicationProperties: dlt.message.ApplicationProperties,
+	}
+	if err := m.sender.SendMessage(ctx, msg, nil); err != nil {
+		return err
+	}
+
+	return m.receiver.CompleteMessage(ctx, dlt.message, nil)
+}
+
+// Purge completes (removing) every dead-lettered task for which filter
+// returns true, returning how many were removed
+func (m *DLQManager) Purge(ctx context.Context, filter func(DeadLetteredTask) bool) (int, error) {
+	purged := 0
+	for {
+		messages, err := m.receiver.ReceiveMessages(ctx, 50, nil)
+		if err != nil {
+			return purged, err
+		}
+		if len(messages) == 0 {
+			return purged, nil
+		}
+
+		for _, msg := range messages {
+			dlt, err := decode(msg)
+			if err != nil {
+				if abandonErr := m.receiver.AbandonMessage(ctx, msg, nil); abandonErr != nil {
+					return purged, abandonErr
+				}
+				continue
+			}
+			if !filter(dlt) {
+				if err := m.receiver.AbandonMessage(ctx, msg, nil); err != nil {
+					return purged, err
+				}
+				continue
+			}
+			if err := m.receiver.CompleteMessage(ctx, msg, nil); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+}
+
+// find scans the dead-letter sub-queue for the task matching uuid, leaving
+// every other message it sees - including ones that fail to decode - locked-
+// then-abandoned back onto the sub-queue
+func (m *DLQManager) find(ctx context.Context, uuid string) (*DeadLetteredTask, error) {
+	for {
+		messages, err := m.receiver.ReceiveMessages(ctx, 50, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			return nil, nil
+		}
+
+		var found *DeadLetteredTask
+		for _, msg := range messages {
+			dlt, err := decode(msg)
+			if err != nil {
+				if abandonErr := m.receiver.AbandonMessage(ctx, msg, nil); abandonErr != nil {
+					return nil, abandonErr
+				}
+				continue
+			}
+			if found == nil && dlt.Signature.UUID == uuid {
+				found = &dlt
+				continue
+			}
+			if err := m.receiver.AbandonMessage(ctx, msg, nil); err != nil {
+				return nil, err
+			}
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+}
+
+func decode(msg *azservicebus.ReceivedMessage) (DeadLetteredTask, error) {
+	sig := new(tasks.Signature)
+	if err := json.Unmarshal(msg.Body, sig); err != nil {
+		return DeadLetteredTask{}, err
+	}
+
+	dlt := DeadLetteredTask{Signature: sig, message: msg}
+	if msg.DeadLetterReason != nil {
+		dlt.DeadLetterReason = *msg.DeadLetterReason
+	}
+	if msg.DeadLetterErrorDescription != nil {
+		dlt.DeadLetterErrorDescription = *msg.DeadLetterErrorDescription
+	}
+	return dlt, nil
+}
@@ -0,0 +1,156 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDLQ is a dlqReceiver/dlqSender backed by an in-memory slice of
+// messages, recording which ones get completed or abandoned
+type fakeDLQ struct {
+	messages  []*azservicebus.ReceivedMessage
+	completed []*azservicebus.ReceivedMessage
+	abandoned []*azservicebus.ReceivedMessage
+	sent      []*azservicebus.Message
+}
+
+func (f *fakeDLQ) PeekMessages(ctx context.Context, max int, options *azservicebus.PeekMessagesOptions) ([]*azservicebus.ReceivedMessage, error) {
+	if max > len(f.messages) {
+		max = len(f.messages)
+	}
+	return f.messages[:max], nil
+}
+
+func (f *fakeDLQ) ReceiveMessages(ctx context.Context, max int, options *azservicebus.ReceiveMessagesOptions) ([]*azservicebus.ReceivedMessage, error) {
+	if max > len(f.messages) {
+		max = len(f.messages)
+	}
+	batch := f.messages[:max]
+	f.messages = f.messages[max:]
+	return batch, nil
+}
+
+func (f *fakeDLQ) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	f.completed = append(f.completed, message)
+	return nil
+}
+
+func (f *fakeDLQ) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	f.abandoned = append(f.abandoned, message)
+	return nil
+}
+
+func (f *fakeDLQ) SendMessage(ctx context.Context, message *azservicebus.Message, options *azservicebus.SendMessageOptions) error {
+	f.sent = append(f.sent, message)
+	return nil
+}
+
+func deadLetteredMessage(t *testing.T, uuid string) *azservicebus.ReceivedMessage {
+	body, err := json.Marshal(&tasks.Signature{UUID: uuid, Name: "test_task"})
+	require.NoError(t, err)
+	return &azservicebus.ReceivedMessage{Body: body}
+}
+
+func TestPeekDoesNotRemoveMessages(t *testing.T) {
+	fake := &fakeDLQ{messages: []*azservicebus.ReceivedMessage{deadLetteredMessage(t, "uuid-1"), deadLetteredMessage(t, "uuid-2")}}
+	m := &DLQManager{queue: "q", receiver: fake, sender: fake}
+
+	out, err := m.Peek(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "uuid-1", out[0].Signature.UUID)
+	assert.Empty(t, fake.completed)
+	assert.Empty(t, fake.abandoned)
+	assert.Len(t, fake.messages, 2, "peek must not drain the underlying queue")
+}
+
+func TestReplayRepublishesAndCompletesOnlyTheMatch(t *testing.T) {
+	sessionID := "session-1"
+	target := deadLetteredMessage(t, "uuid-2")
+	target.SessionID = &sessionID
+	target.ApplicationProperties = map[string]interface{}{"routingKey": "my-key"}
+
+	fake := &fakeDLQ{messages: []*azservicebus.ReceivedMessage{
+		deadLetteredMessage(t, "uuid-1"),
+		target,
+		deadLetteredMessage(t, "uuid-3"),
+	}}
+	m := &DLQManager{queue: "q", receiver: fake, sender: fake}
+
+	err := m.Replay(context.Background(), "uuid-2")
+	require.NoError(t, err)
+
+	require.Len(t, fake.sent, 1)
+	assert.Equal(t, target.Body, fake.sent[0].Body)
+	assert.Equal(t, &sessionID, fake.sent[0].SessionID)
+	assert.Equal(t, target.ApplicationProperties, fake.sent[0].ApplicationProperties)
+
+	require.Len(t, fake.completed, 1)
+	assert.Same(t, target, fake.completed[0])
+
+	// the other two messages in the batch must be abandoned, not left locked
+	assert.Len(t, fake.abandoned, 2)
+}
+
+func TestReplayNotFound(t *testing.T) {
+	fake := &fakeDLQ{messages: []*azservicebus.ReceivedMessage{deadLetteredMessage(t, "uuid-1")}}
+	m := &DLQManager{queue: "q", receiver: fake, sender: fake}
+
+	err := m.Replay(context.Background(), "does-not-exist")
+	assert.Error(t, err)
+	assert.Empty(t, fake.sent)
+}
+
+func TestFindAbandonsMessagesThatFailToDecode(t *testing.T) {
+	bad := &azservicebus.ReceivedMessage{Body: []byte("not json")}
+	target := deadLetteredMessage(t, "uuid-1")
+
+	fake := &fakeDLQ{messages: []*azservicebus.ReceivedMessage{bad, target}}
+	m := &DLQManager{queue: "q", receiver: fake, sender: fake}
+
+	dlt, err := m.find(context.Background(), "uuid-1")
+	require.NoError(t, err)
+	require.NotNil(t, dlt)
+	assert.Equal(t, "uuid-1", dlt.Signature.UUID)
+	assert.Contains(t, fake.abandoned, bad)
+	assert.NotContains(t, fake.abandoned, target)
+}
+
+func TestPurgeOnlyRemovesMatchingTasks(t *testing.T) {
+	skipped := deadLetteredMessage(t, "uuid-2")
+	fake := &fakeDLQ{messages: []*azservicebus.ReceivedMessage{
+		deadLetteredMessage(t, "uuid-1"),
+		skipped,
+		deadLetteredMessage(t, "uuid-3"),
+	}}
+	m := &DLQManager{queue: "q", receiver: fake, sender: fake}
+
+	purged, err := m.Purge(context.Background(), func(dlt DeadLetteredTask) bool {
+		return dlt.Signature.UUID != "uuid-2"
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	assert.Len(t, fake.completed, 2)
+
+	// the message the filter didn't match must be abandoned, not left
+	// received-but-unsettled
+	require.Len(t, fake.abandoned, 1)
+	assert.Same(t, skipped, fake.abandoned[0])
+}
+
+func TestPurgeAbandonsMessagesThatFailToDecode(t *testing.T) {
+	bad := &azservicebus.ReceivedMessage{Body: []byte("not json")}
+	fake := &fakeDLQ{messages: []*azservicebus.ReceivedMessage{bad}}
+	m := &DLQManager{queue: "q", receiver: fake, sender: fake}
+
+	purged, err := m.Purge(context.Background(), func(DeadLetteredTask) bool { return true })
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	assert.Contains(t, fake.abandoned, bad)
+}
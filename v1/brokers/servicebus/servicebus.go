@@ -4,106 +4,441 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
-	servicebus "github.com/Azure/azure-service-bus-go"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
 	"github.com/RichardKnop/machinery/v1/brokers/iface"
+	"github.com/RichardKnop/machinery/v1/brokers/servicebus/dlq"
 	"github.com/RichardKnop/machinery/v1/common"
 	"github.com/RichardKnop/machinery/v1/config"
 	"github.com/RichardKnop/machinery/v1/log"
 	"github.com/RichardKnop/machinery/v1/tasks"
 )
 
+// sessionLockRenewalInterval is how often a worker renews the lock on the
+// session it is currently draining
+const sessionLockRenewalInterval = 10 * time.Second
+
+// minLockRenewalInterval is the floor applied when deriving a message lock's
+// renewal interval from its remaining lock duration
+const minLockRenewalInterval = 10 * time.Second
+
+// lockRenewalBackoff is the fraction of a message's remaining lock duration
+// a renewal is scheduled at, when no explicit interval is configured
+const lockRenewalBackoff = 0.6
+
+// settler is the subset of *azservicebus.Receiver and *azservicebus.SessionReceiver
+// that consumeOne needs to settle a message, so the same settlement logic
+// works for both the plain and the session-aware consumption paths
+type settler interface {
+	CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error
+	AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error
+	DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error
+}
+
+// lockRenewer is implemented by *azservicebus.Receiver but not by
+// *azservicebus.SessionReceiver, which renews its session's lock as a whole
+// instead (see renewSessionLock) rather than per message
+type lockRenewer interface {
+	RenewMessageLock(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.RenewMessageLockOptions) error
+}
+
+// defaultCancelTopicName is the control topic used for cross-broker task
+// cancellation when config.ServiceBusConfig.CancelTopicName isn't set
+const defaultCancelTopicName = "machinery-cancel"
+
 // Broker struct to hold all service bus related stuff
 type Broker struct {
 	common.Broker
-	service      *servicebus.Namespace
-	publishQueue *servicebus.Queue
+	client       *azservicebus.Client
+	admin        *admin.Client
+	sender       *azservicebus.Sender
 	processingWG sync.WaitGroup // use wait group to make sure task processing completes on interrupt signal
 
+	// topicMode is true when the broker fans a single task signature out to
+	// a topic and its subscriptions instead of publishing to a single queue
+	topicMode bool
+
+	// inFlight tracks the cancel funcs of tasks this broker is currently
+	// processing, keyed by task UUID, so CancelTask can stop them early
+	inFlight *inFlight
+
+	// cancelSubscription is this worker's subscription on the
+	// cancellation topic, torn down in StopConsuming so consumer tags
+	// that change across restarts don't leak subscriptions forever
+	cancelSubscription string
+
 	stopReceiving chan struct{}
 }
 
+// inFlight tracks the cancel funcs for tasks currently being processed,
+// keyed by task UUID
+type inFlight struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{cancels: make(map[string]context.CancelFunc)}
+}
+
+func (f *inFlight) add(uuid string, cancel context.CancelFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[uuid] = cancel
+}
+
+func (f *inFlight) remove(uuid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cancels, uuid)
+}
+
+// cancel cancels the task's context if it is currently in flight on this
+// broker, reporting whether it found one
+func (f *inFlight) cancel(uuid string) bool {
+	f.mu.Lock()
+	cancel, ok := f.cancels[uuid]
+	f.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
 // New creates a new broker
 func New(cnf *config.Config) (iface.Broker, error) {
-	b := &Broker{Broker: common.NewBroker(cnf), stopReceiving: make(chan struct{})}
-	if cnf.ServiceBus != nil && cnf.ServiceBus.Client != nil {
-		b.service = cnf.ServiceBus.Client
-	} else {
-		ns, err := servicebus.NewNamespace(servicebus.NamespaceWithConnectionString(cnf.Broker))
-		if err != nil {
-			return nil, err
-		}
-		b.service = ns
-	}
-	ctx := context.Background()
-	_, err := b.service.NewQueueManager().Get(ctx, cnf.DefaultQueue)
+	b := &Broker{Broker: common.NewBroker(cnf), stopReceiving: make(chan struct{}), inFlight: newInFlight()}
+
+	client, adminClient, err := newClients(cnf)
 	if err != nil {
-		if _, ok := err.(servicebus.ErrNotFound); ok {
-			return nil, fmt.Errorf("queue %s does not exist", cnf.DefaultQueue)
+		return nil, err
+	}
+	b.client = client
+	b.admin = adminClient
+
+	sbCnf := cnf.ServiceBus
+	if sbCnf != nil && sbCnf.TopicMode {
+		b.topicMode = true
+		if err := b.setupTopic(sbCnf); err != nil {
+			return nil, err
 		}
+	} else if err := b.setupQueue(cnf.DefaultQueue, sbCnf); err != nil {
 		return nil, err
 	}
-	queue, err := b.service.NewQueue(b.GetConfig().DefaultQueue)
+
+	sender, err := b.newSender()
 	if err != nil {
 		return nil, err
 	}
-	b.publishQueue = queue
+	b.sender = sender
+
 	return b, nil
 }
 
+// newClients builds the data-plane and admin Service Bus clients, preferring
+// an injected client, then, when config.ServiceBusConfig.Namespace is set, an
+// azidentity credential resolved from config.ServiceBusConfig.CredentialType,
+// and otherwise Config.Broker as a connection string
+func newClients(cnf *config.Config) (*azservicebus.Client, *admin.Client, error) {
+	sbCnf := cnf.ServiceBus
+	if sbCnf != nil && sbCnf.Client != nil {
+		return sbCnf.Client, sbCnf.AdminClient, nil
+	}
+
+	if sbCnf == nil || sbCnf.Namespace == "" {
+		client, err := azservicebus.NewClientFromConnectionString(cnf.Broker, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		adminClient, err := admin.NewClientFromConnectionString(cnf.Broker, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, adminClient, nil
+	}
+
+	cred, err := newCredential(sbCnf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := azservicebus.NewClient(sbCnf.Namespace, cred, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	adminClient, err := admin.NewClient(sbCnf.Namespace, cred, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, adminClient, nil
+}
+
+// newCredential selects an azidentity credential based on
+// config.ServiceBusConfig.CredentialType, defaulting to
+// DefaultAzureCredential when one isn't set
+func newCredential(sbCnf *config.ServiceBusConfig) (azcore.TokenCredential, error) {
+	switch sbCnf.CredentialType {
+	case config.ServiceBusCredentialWorkloadIdentity:
+		return azidentity.NewWorkloadIdentityCredential(nil)
+	case config.ServiceBusCredentialManagedIdentity:
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if sbCnf.ManagedIdentityClientID != "" {
+			opts.ID = azidentity.ClientID(sbCnf.ManagedIdentityClientID)
+		}
+		return azidentity.NewManagedIdentityCredential(opts)
+	default:
+		return azidentity.NewDefaultAzureCredential(nil)
+	}
+}
+
+// setupQueue makes sure the default queue exists, creating it when
+// AutoCreate is set
+func (b *Broker) setupQueue(queueName string, sbCnf *config.ServiceBusConfig) error {
+	ctx := context.Background()
+	if _, err := b.admin.GetQueue(ctx, queueName, nil); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		if sbCnf == nil || !sbCnf.AutoCreate {
+			return fmt.Errorf("queue %s does not exist", queueName)
+		}
+		if _, err := b.admin.CreateQueue(ctx, queueName, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupTopic makes sure the topic and this worker's subscription exist,
+// creating them (and a SQL filter derived from sbCnf.SubscriptionFilter)
+// when AutoCreate is set
+func (b *Broker) setupTopic(sbCnf *config.ServiceBusConfig) error {
+	ctx := context.Background()
+
+	if _, err := b.admin.GetTopic(ctx, sbCnf.TopicName, nil); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		if !sbCnf.AutoCreate {
+			return fmt.Errorf("topic %s does not exist", sbCnf.TopicName)
+		}
+		if _, err := b.admin.CreateTopic(ctx, sbCnf.TopicName, nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err := b.admin.GetSubscription(ctx, sbCnf.TopicName, sbCnf.SubscriptionName, nil); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		if !sbCnf.AutoCreate {
+			return fmt.Errorf("subscription %s does not exist", sbCnf.SubscriptionName)
+		}
+		if _, err := b.admin.CreateSubscription(ctx, sbCnf.TopicName, sbCnf.SubscriptionName, nil); err != nil {
+			return err
+		}
+		if sbCnf.SubscriptionFilter != "" {
+			ruleName := "machinery-routing"
+			ruleOpts := &admin.CreateRuleOptions{
+				Name:   &ruleName,
+				Filter: &admin.SQLFilter{Expression: sbCnf.SubscriptionFilter},
+			}
+			if _, err := b.admin.CreateRule(ctx, sbCnf.TopicName, sbCnf.SubscriptionName, ruleOpts); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isNotFound reports whether err is a Service Bus "entity not found" error
+func isNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// newSender resolves the sender used by Publish, pointed at the topic when
+// running in TopicMode and at the default queue otherwise
+func (b *Broker) newSender() (*azservicebus.Sender, error) {
+	if b.topicMode {
+		return b.client.NewSender(b.GetConfig().ServiceBus.TopicName, nil)
+	}
+	return b.client.NewSender(b.GetConfig().DefaultQueue, nil)
+}
+
+// newReceiver resolves the queue or subscription receiver to consume from.
+// This SDK has no prefetch-count receiver option; batching multiple
+// messages at a time happens via the maxMessageCount argument passed to
+// ReceiveMessages in StartConsuming instead.
+func (b *Broker) newReceiver() (*azservicebus.Receiver, error) {
+	if b.topicMode {
+		return b.client.NewReceiverForSubscription(b.GetConfig().ServiceBus.TopicName, b.GetConfig().ServiceBus.SubscriptionName, nil)
+	}
+	return b.client.NewReceiverForQueue(b.GetConfig().DefaultQueue, nil)
+}
+
+// DLQManager opens queueName's dead-letter sub-queue for inspection and
+// replay. server.Server uses this to expose DLQ tooling when it is backed
+// by this broker.
+func (b *Broker) DLQManager(queueName string) (*dlq.DLQManager, error) {
+	return dlq.New(b.client, queueName)
+}
+
+// CancelTask publishes a control message carrying taskUUID to the shared
+// cancellation topic. Every consuming broker subscribes to that topic and
+// cancels the matching in-flight task's context, if it is running one.
+func (b *Broker) CancelTask(ctx context.Context, taskUUID string) error {
+	sender, err := b.client.NewSender(b.cancelTopicName(), nil)
+	if err != nil {
+		return err
+	}
+	defer sender.Close(ctx)
+
+	return sender.SendMessage(ctx, &azservicebus.Message{Body: []byte(taskUUID)}, nil)
+}
+
+func (b *Broker) cancelTopicName() string {
+	if sbCnf := b.GetConfig().ServiceBus; sbCnf != nil && sbCnf.CancelTopicName != "" {
+		return sbCnf.CancelTopicName
+	}
+	return defaultCancelTopicName
+}
+
+// watchCancellations subscribes this worker to the shared cancellation
+// topic and cancels the context of any in-flight task whose UUID arrives on
+// it, until ctx is done
+func (b *Broker) watchCancellations(ctx context.Context, subscription string) {
+	topic := b.cancelTopicName()
+
+	if err := b.ensureCancelSubscription(topic, subscription); err != nil {
+		log.ERROR.Printf("Error setting up cancellation subscription. Error: %v", err)
+		return
+	}
+
+	receiver, err := b.client.NewReceiverForSubscription(topic, subscription, nil)
+	if err != nil {
+		log.ERROR.Printf("Error creating cancellation receiver. Error: %v", err)
+		return
+	}
+	defer receiver.Close(context.Background())
+
+	for {
+		messages, err := receiver.ReceiveMessages(ctx, 1, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.ERROR.Printf("Error receiving cancellation message. Error: %v", err)
+			continue
+		}
+		for _, msg := range messages {
+			b.inFlight.cancel(string(msg.Body))
+			if err := receiver.CompleteMessage(context.Background(), msg, nil); err != nil {
+				log.ERROR.Printf("Error completing cancellation message. Error: %v", err)
+			}
+		}
+	}
+}
+
+// ensureCancelSubscription creates the cancellation topic and this worker's
+// subscription to it if they don't already exist and sbCnf.AutoCreate is
+// set, matching every other auto-provisioning path in this file
+func (b *Broker) ensureCancelSubscription(topic, subscription string) error {
+	ctx := context.Background()
+	sbCnf := b.GetConfig().ServiceBus
+
+	if _, err := b.admin.GetTopic(ctx, topic, nil); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		if sbCnf == nil || !sbCnf.AutoCreate {
+			return fmt.Errorf("cancellation topic %s does not exist", topic)
+		}
+		if _, err := b.admin.CreateTopic(ctx, topic, nil); err != nil {
+			return err
+		}
+	}
+
+	if _, err := b.admin.GetSubscription(ctx, topic, subscription, nil); err != nil {
+		if !isNotFound(err) {
+			return err
+		}
+		if sbCnf == nil || !sbCnf.AutoCreate {
+			return fmt.Errorf("cancellation subscription %s does not exist", subscription)
+		}
+		if _, err := b.admin.CreateSubscription(ctx, topic, subscription, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // StartConsuming ...
 func (b *Broker) StartConsuming(consumerTag string, concurrency int, taskProcessor iface.TaskProcessor) (bool, error) {
 	b.Broker.StartConsuming(consumerTag, concurrency, taskProcessor)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	queue := b.publishQueue
-	var err error
-	// we need a new queue connection with prefetch count
-	if concurrency > 1 {
-		queue, err = b.service.NewQueue(b.GetConfig().DefaultQueue, servicebus.QueueWithPrefetchCount(uint32(concurrency)))
-		if err != nil {
-			return false, err
-		}
+	go func() {
+		<-b.GetStopChan()
+		cancel()
+	}()
+
+	b.cancelSubscription = "machinery-cancel-" + consumerTag
+	go b.watchCancellations(ctx, b.cancelSubscription)
+
+	if sbCnf := b.GetConfig().ServiceBus; sbCnf != nil && sbCnf.SessionsEnabled {
+		b.consumeSessions(ctx, concurrency, taskProcessor)
+		close(b.stopReceiving)
+		return b.GetRetry(), nil
 	}
 
-	// Define msg chan
-	msgChan := make(chan *servicebus.Message, concurrency)
-	// Define a function that should be executed when a message is received.
-	var concurrentHandler servicebus.HandlerFunc = func(ctx context.Context, msg *servicebus.Message) error {
-		msgChan <- msg
-		return nil
+	receiver, err := b.newReceiver()
+	if err != nil {
+		cancel()
+		return false, err
 	}
 
+	// Define msg chan
+	msgChan := make(chan *azservicebus.ReceivedMessage, concurrency)
+
 	// Define msg workers
 	for i := 0; i < concurrency; i++ {
 		go func() {
 			for msg := range msgChan {
 				b.processingWG.Add(1)
-				b.consumeOne(context.Background(), msg, taskProcessor)
+				b.consumeOne(context.Background(), receiver, msg, taskProcessor)
 				b.processingWG.Done()
 			}
 		}()
 	}
 
-	go func() {
-		<-b.GetStopChan()
-		cancel()
-	}()
-
 	for {
-		err := queue.Receive(ctx, concurrentHandler)
-		if err == nil {
-			break
+		messages, err := receiver.ReceiveMessages(ctx, concurrency, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.ERROR.Printf("Error when receiving messages. Error: %v", err)
+			continue
+		}
+		for _, msg := range messages {
+			msgChan <- msg
 		}
-
-		log.ERROR.Printf("Error when receiving messages. Error: %v", err)
-		continue
 	}
 
+	receiver.Close(context.Background())
+
 	close(b.stopReceiving)
 
 	close(msgChan)
@@ -111,6 +446,84 @@ func (b *Broker) StartConsuming(consumerTag string, concurrency int, taskProcess
 	return b.GetRetry(), nil
 }
 
+// consumeSessions runs `concurrency` workers that each accept a session at a
+// time, fully drain it in order, then move on to the next one - giving
+// per-group ordered execution without touching the default, session-less path
+func (b *Broker) consumeSessions(ctx context.Context, concurrency int, taskProcessor iface.TaskProcessor) {
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				b.consumeSession(ctx, taskProcessor)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// consumeSession accepts the next available session, processes every
+// message in it sequentially while renewing the session lock in the
+// background, then releases it
+func (b *Broker) consumeSession(ctx context.Context, taskProcessor iface.TaskProcessor) {
+	session, err := b.acceptNextSession(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.ERROR.Printf("Error when accepting next session. Error: %v", err)
+		return
+	}
+	defer session.Close(context.Background())
+
+	renewCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.renewSessionLock(renewCtx, session)
+
+	for {
+		messages, err := session.ReceiveMessages(ctx, 1, nil)
+		if err != nil {
+			log.ERROR.Printf("Error when receiving session messages. Error: %v", err)
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		for _, msg := range messages {
+			b.processingWG.Add(1)
+			b.consumeOne(context.Background(), session, msg, taskProcessor)
+			b.processingWG.Done()
+		}
+	}
+}
+
+// acceptNextSession accepts the next available session from the queue or,
+// in TopicMode, from this worker's subscription
+func (b *Broker) acceptNextSession(ctx context.Context) (*azservicebus.SessionReceiver, error) {
+	if b.topicMode {
+		return b.client.AcceptNextSessionForSubscription(ctx, b.GetConfig().ServiceBus.TopicName, b.GetConfig().ServiceBus.SubscriptionName, nil)
+	}
+	return b.client.AcceptNextSessionForQueue(ctx, b.GetConfig().DefaultQueue, nil)
+}
+
+// renewSessionLock keeps a session's lock alive for as long as a worker is
+// draining it
+func (b *Broker) renewSessionLock(ctx context.Context, session *azservicebus.SessionReceiver) {
+	ticker := time.NewTicker(sessionLockRenewalInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := session.RenewSessionLock(ctx, nil); err != nil {
+				log.ERROR.Printf("Error when renewing session lock. Error: %v", err)
+			}
+		}
+	}
+}
+
 // StopConsuming ...
 func (b *Broker) StopConsuming() {
 	b.Broker.StopConsuming()
@@ -120,6 +533,13 @@ func (b *Broker) StopConsuming() {
 	// Wait for all processing tasks to finish
 	b.processingWG.Wait()
 
+	// Tear down this worker's cancellation subscription rather than
+	// leaking one per consumer tag for the lifetime of the topic
+	if b.cancelSubscription != "" {
+		if _, err := b.admin.DeleteSubscription(context.Background(), b.cancelTopicName(), b.cancelSubscription, nil); err != nil && !isNotFound(err) {
+			log.ERROR.Printf("Error deleting cancellation subscription. Error: %v", err)
+		}
+	}
 }
 
 // Publish message to queue
@@ -131,53 +551,144 @@ func (b *Broker) Publish(ctx context.Context, sig *tasks.Signature) error {
 		return fmt.Errorf("JSON marshal error: %s", err)
 	}
 
-	msg := servicebus.NewMessage(sigMarshaled)
-	// Set message id to machinery task UUID
-	msg.ID = sig.UUID
+	msgID := sig.UUID
+	msg := &azservicebus.Message{
+		Body:      sigMarshaled,
+		MessageID: &msgID,
+	}
+	if b.topicMode && sig.RoutingKey != "" {
+		msg.ApplicationProperties = map[string]interface{}{"routingKey": sig.RoutingKey}
+	}
+
+	if sbCnf := b.GetConfig().ServiceBus; sbCnf != nil && sbCnf.SessionsEnabled {
+		if sessionID := sessionIDFor(sig); sessionID != "" {
+			msg.SessionID = &sessionID
+		}
+	}
+
 	// Check the ETA signature field, if it is set and it is in the future,
 	// delay the task
 	if sig.ETA != nil {
 		now := time.Now().UTC()
 		if sig.ETA.After(now) {
-			msg.ScheduleAt(*sig.ETA)
+			if _, err := b.sender.ScheduleMessages(ctx, []*azservicebus.Message{msg}, *sig.ETA, nil); err != nil {
+				log.ERROR.Printf("Error when scheduling a message: %v", err)
+				return err
+			}
+			return nil
 		}
 	}
 
-	err = b.publishQueue.Send(ctx, msg)
-	if err != nil {
+	if err := b.sender.SendMessage(ctx, msg, nil); err != nil {
 		log.ERROR.Printf("Error when sending a message: %v", err)
 		return err
 	}
 	return nil
 }
 
-func (b *Broker) consumeOne(ctx context.Context, msg *servicebus.Message, taskProcessor iface.TaskProcessor) error {
-	if len(msg.Data) == 0 {
+// sessionIDFor returns the session a signature belongs to: its
+// x-session-id header when set, falling back to its group UUID, or ""
+// when neither is set
+func sessionIDFor(sig *tasks.Signature) string {
+	if headerID, ok := sig.Headers["x-session-id"].(string); ok && headerID != "" {
+		return headerID
+	}
+	return sig.GroupUUID
+}
+
+func (b *Broker) consumeOne(ctx context.Context, receiver settler, msg *azservicebus.ReceivedMessage, taskProcessor iface.TaskProcessor) error {
+	if len(msg.Body) == 0 {
 		log.ERROR.Printf("received an empty message, the msg was %v", msg)
-		return msg.DeadLetter(ctx, fmt.Errorf("empty message data"))
+		return receiver.DeadLetterMessage(ctx, msg, nil)
 	}
 	sig := new(tasks.Signature)
-	decoder := json.NewDecoder(bytes.NewBuffer(msg.Data))
+	decoder := json.NewDecoder(bytes.NewBuffer(msg.Body))
 	decoder.UseNumber()
 	if err := decoder.Decode(sig); err != nil {
 		log.ERROR.Printf("unmarshal error. the message is %v", msg)
-		return msg.DeadLetter(ctx, fmt.Errorf("unmarshal msg data error"))
+		return receiver.DeadLetterMessage(ctx, msg, nil)
 	}
 	// If the task is not registered return an error
 	// and leave the message in the queue
 	if !b.IsTaskRegistered(sig.Name) {
 		log.ERROR.Printf("task %s is not registered", sig.Name)
 		if sig.IgnoreWhenTaskNotRegistered {
-			return msg.DeadLetter(ctx, fmt.Errorf("task %s is not registered", sig.Name))
+			return receiver.DeadLetterMessage(ctx, msg, nil)
 		}
-		return msg.Abandon(ctx)
+		return receiver.AbandonMessage(ctx, msg, nil)
 	}
 
-	err := taskProcessor.Process(sig)
+	taskCtx, cancelTask := context.WithCancel(ctx)
+	b.inFlight.add(sig.UUID, cancelTask)
+	defer func() {
+		b.inFlight.remove(sig.UUID)
+		cancelTask()
+	}()
+
+	stopRenewal := func() {}
+	if renewer, ok := receiver.(lockRenewer); ok {
+		stopRenewal = b.startLockRenewal(renewer, msg)
+	}
+	err := taskProcessor.Process(taskCtx, sig)
+	stopRenewal()
 	if err != nil {
 		log.ERROR.Printf("failed process of task %v", err)
-		return msg.Abandon(ctx)
+		return receiver.AbandonMessage(ctx, msg, nil)
+	}
+	// Call CompleteMessage() after successfully consuming and processing the message
+	return receiver.CompleteMessage(ctx, msg, nil)
+}
+
+// startLockRenewal keeps msg's lock alive for as long as it is being
+// processed, so a task that runs longer than the queue's lock duration
+// doesn't lose its lock and get redelivered. It renews at
+// config.ServiceBusConfig.LockRenewalInterval, or at 60% of the remaining
+// lock duration (minimum 10s) when that isn't set, stopping after
+// MaxLockRenewalDuration or when the returned func is called.
+func (b *Broker) startLockRenewal(receiver lockRenewer, msg *azservicebus.ReceivedMessage) (stop func()) {
+	sbCnf := b.GetConfig().ServiceBus
+	if sbCnf == nil || !sbCnf.LockRenewalEnabled || msg.LockedUntil == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var deadline time.Time
+	if sbCnf.MaxLockRenewalDuration > 0 {
+		deadline = time.Now().Add(sbCnf.MaxLockRenewalDuration)
 	}
-	// Call Complete() after successfully consuming and processing the message
-	return msg.Complete(ctx)
-}
\ No newline at end of file
+
+	go func() {
+		for {
+			interval := lockRenewalInterval(*msg.LockedUntil, sbCnf.LockRenewalInterval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return
+			}
+			if err := receiver.RenewMessageLock(ctx, msg, nil); err != nil {
+				log.ERROR.Printf("Error when renewing message lock. Error: %v", err)
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// lockRenewalInterval returns the configured interval when set, otherwise
+// lockRenewalBackoff of the time remaining until lockedUntil, floored at
+// minLockRenewalInterval
+func lockRenewalInterval(lockedUntil time.Time, configured time.Duration) time.Duration {
+	if configured > 0 {
+		return configured
+	}
+	remaining := time.Duration(float64(time.Until(lockedUntil)) * lockRenewalBackoff)
+	if remaining < minLockRenewalInterval {
+		return minLockRenewalInterval
+	}
+	return remaining
+}
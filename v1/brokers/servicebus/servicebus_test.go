@@ -0,0 +1,160 @@
+package servicebus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/RichardKnop/machinery/v1/common"
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSettler is a settler that records how many times its lock was renewed
+type fakeSettler struct {
+	mu       sync.Mutex
+	renewals int
+}
+
+func (f *fakeSettler) CompleteMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions) error {
+	return nil
+}
+
+func (f *fakeSettler) AbandonMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions) error {
+	return nil
+}
+
+func (f *fakeSettler) DeadLetterMessage(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions) error {
+	return nil
+}
+
+func (f *fakeSettler) RenewMessageLock(ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.RenewMessageLockOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renewals++
+	return nil
+}
+
+func (f *fakeSettler) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.renewals
+}
+
+func newTestBroker(sbCnf *config.ServiceBusConfig) *Broker {
+	return &Broker{Broker: common.NewBroker(&config.Config{ServiceBus: sbCnf})}
+}
+
+func TestStartLockRenewalRenewsPeriodically(t *testing.T) {
+	b := newTestBroker(&config.ServiceBusConfig{
+		LockRenewalEnabled:  true,
+		LockRenewalInterval: 10 * time.Millisecond,
+	})
+
+	lockedUntil := time.Now().Add(time.Second)
+	msg := &azservicebus.ReceivedMessage{LockedUntil: &lockedUntil}
+	fake := &fakeSettler{}
+
+	stop := b.startLockRenewal(fake, msg)
+	time.Sleep(35 * time.Millisecond)
+	stop()
+
+	assert.GreaterOrEqual(t, fake.count(), 2)
+}
+
+func TestStartLockRenewalDisabled(t *testing.T) {
+	b := newTestBroker(&config.ServiceBusConfig{LockRenewalEnabled: false})
+
+	lockedUntil := time.Now().Add(time.Second)
+	msg := &azservicebus.ReceivedMessage{LockedUntil: &lockedUntil}
+	fake := &fakeSettler{}
+
+	stop := b.startLockRenewal(fake, msg)
+	stop()
+
+	assert.Equal(t, 0, fake.count())
+}
+
+func TestStartLockRenewalStopsAtMaxDuration(t *testing.T) {
+	b := newTestBroker(&config.ServiceBusConfig{
+		LockRenewalEnabled:     true,
+		LockRenewalInterval:    5 * time.Millisecond,
+		MaxLockRenewalDuration: 15 * time.Millisecond,
+	})
+
+	lockedUntil := time.Now().Add(time.Second)
+	msg := &azservicebus.ReceivedMessage{LockedUntil: &lockedUntil}
+	fake := &fakeSettler{}
+
+	stop := b.startLockRenewal(fake, msg)
+	defer stop()
+	time.Sleep(60 * time.Millisecond)
+
+	countAtDeadline := fake.count()
+	time.Sleep(30 * time.Millisecond)
+
+	assert.Equal(t, countAtDeadline, fake.count())
+}
+
+func TestLockRenewalInterval(t *testing.T) {
+	assert.Equal(t, 5*time.Second, lockRenewalInterval(time.Now(), 5*time.Second))
+
+	lockedUntil := time.Now().Add(time.Second)
+	assert.Equal(t, minLockRenewalInterval, lockRenewalInterval(lockedUntil, 0))
+}
+
+func TestSessionIDForGroupUUID(t *testing.T) {
+	sig := &tasks.Signature{GroupUUID: "group-1"}
+	assert.Equal(t, "group-1", sessionIDFor(sig))
+}
+
+func TestSessionIDForHeaderOverridesGroupUUID(t *testing.T) {
+	sig := &tasks.Signature{
+		GroupUUID: "group-1",
+		Headers:   tasks.Headers{"x-session-id": "header-session"},
+	}
+	assert.Equal(t, "header-session", sessionIDFor(sig))
+}
+
+func TestSessionIDForEmptyWhenNeitherSet(t *testing.T) {
+	sig := &tasks.Signature{}
+	assert.Equal(t, "", sessionIDFor(sig))
+}
+
+func TestCancelTopicNameDefaultsWhenUnset(t *testing.T) {
+	b := newTestBroker(nil)
+	assert.Equal(t, defaultCancelTopicName, b.cancelTopicName())
+
+	b = newTestBroker(&config.ServiceBusConfig{})
+	assert.Equal(t, defaultCancelTopicName, b.cancelTopicName())
+}
+
+func TestCancelTopicNameHonorsConfig(t *testing.T) {
+	b := newTestBroker(&config.ServiceBusConfig{CancelTopicName: "custom-cancel-topic"})
+	assert.Equal(t, "custom-cancel-topic", b.cancelTopicName())
+}
+
+func TestInFlightCancelInvokesRegisteredCancelFunc(t *testing.T) {
+	f := newInFlight()
+	canceled := false
+	f.add("uuid-1", func() { canceled = true })
+
+	assert.True(t, f.cancel("uuid-1"))
+	assert.True(t, canceled)
+}
+
+func TestInFlightCancelUnknownUUIDIsNoop(t *testing.T) {
+	f := newInFlight()
+	assert.False(t, f.cancel("does-not-exist"))
+}
+
+func TestInFlightRemoveForgetsTask(t *testing.T) {
+	f := newInFlight()
+	f.add("uuid-1", func() {})
+	f.remove("uuid-1")
+
+	assert.False(t, f.cancel("uuid-1"))
+}
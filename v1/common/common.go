@@ -0,0 +1,83 @@
+// Package common holds functionality common to all broker implementations
+package common
+
+import (
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/brokers/iface"
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/tasks"
+)
+
+// Broker is the base broker structure, embedded by concrete broker
+// implementations to pick up the behavior common to all of them
+type Broker struct {
+	cnf                 *config.Config
+	registeredTaskNames []string
+	retry               bool
+	stopChan            chan struct{}
+	mu                  sync.RWMutex
+}
+
+// NewBroker creates a new Broker instance
+func NewBroker(cnf *config.Config) Broker {
+	return Broker{cnf: cnf, stopChan: make(chan struct{})}
+}
+
+// GetConfig returns the broker config
+func (b *Broker) GetConfig() *config.Config {
+	return b.cnf
+}
+
+// GetStopChan returns the broker's stop channel
+func (b *Broker) GetStopChan() chan struct{} {
+	return b.stopChan
+}
+
+// GetRetry returns whether StartConsuming should be retried after it
+// returns
+func (b *Broker) GetRetry() bool {
+	return b.retry
+}
+
+// SetRegisteredTaskNames sets the list of currently registered task names
+func (b *Broker) SetRegisteredTaskNames(names []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.registeredTaskNames = names
+}
+
+// IsTaskRegistered returns true if the task name is registered with this
+// broker
+func (b *Broker) IsTaskRegistered(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, registeredTaskName := range b.registeredTaskNames {
+		if registeredTaskName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// StartConsuming is the common part of StartConsuming, called by concrete
+// brokers before they set up their own consumption loop
+func (b *Broker) StartConsuming(consumerTag string, concurrency int, taskProcessor iface.TaskProcessor) bool {
+	b.retry = true
+	b.stopChan = make(chan struct{})
+	return b.retry
+}
+
+// StopConsuming is the common part of StopConsuming
+func (b *Broker) StopConsuming() {
+	close(b.stopChan)
+}
+
+// AdjustRoutingKey sets the signature's routing key to the default queue
+// when one hasn't been set explicitly
+func (b *Broker) AdjustRoutingKey(s *tasks.Signature) {
+	if s.RoutingKey != "" {
+		return
+	}
+	s.RoutingKey = b.cnf.DefaultQueue
+}
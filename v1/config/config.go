@@ -0,0 +1,73 @@
+package config
+
+import (
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+)
+
+// Config holds all configuration for our program
+type Config struct {
+	Broker        string
+	DefaultQueue  string
+	ResultBackend string
+
+	ServiceBus *ServiceBusConfig
+}
+
+// ServiceBusCredentialType selects how the servicebus broker authenticates
+// when config.ServiceBusConfig.Namespace is set instead of a connection
+// string
+type ServiceBusCredentialType int
+
+const (
+	// ServiceBusCredentialDefault resolves azidentity.DefaultAzureCredential
+	ServiceBusCredentialDefault ServiceBusCredentialType = iota
+	// ServiceBusCredentialWorkloadIdentity resolves azidentity.WorkloadIdentityCredential
+	ServiceBusCredentialWorkloadIdentity
+	// ServiceBusCredentialManagedIdentity resolves azidentity.ManagedIdentityCredential
+	ServiceBusCredentialManagedIdentity
+)
+
+// ServiceBusConfig holds Service Bus broker specific configuration
+type ServiceBusConfig struct {
+	// Client and AdminClient let callers inject already constructed
+	// clients, bypassing CredentialType/Namespace resolution entirely
+	Client      *azservicebus.Client
+	AdminClient *admin.Client
+
+	// Namespace is the fully qualified Service Bus namespace
+	// (<namespace>.servicebus.windows.net) used together with
+	// CredentialType to build a client via azidentity. When it's left
+	// empty, Config.Broker is used as a connection string instead.
+	Namespace               string
+	CredentialType          ServiceBusCredentialType
+	ManagedIdentityClientID string
+
+	// TopicMode fans a task signature out to a topic and its
+	// subscriptions instead of publishing to a single queue
+	TopicMode          bool
+	TopicName          string
+	SubscriptionName   string
+	SubscriptionFilter string
+
+	// AutoCreate provisions the queue, or the topic and subscription, on
+	// New if they don't already exist
+	AutoCreate bool
+
+	// SessionsEnabled switches Publish and StartConsuming onto the
+	// session-aware path for per-group ordered task processing
+	SessionsEnabled bool
+
+	// LockRenewalEnabled keeps a message's lock alive in the background
+	// for as long as it is being processed, so long-running tasks don't
+	// lose their lock and get redelivered
+	LockRenewalEnabled     bool
+	LockRenewalInterval    time.Duration
+	MaxLockRenewalDuration time.Duration
+
+	// CancelTopicName is the control topic used for cross-broker task
+	// cancellation. Defaults to "machinery-cancel" when empty.
+	CancelTopicName string
+}
@@ -0,0 +1,26 @@
+// Package log abstracts the loggers used throughout machinery so brokers
+// don't depend directly on the standard library logger
+package log
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Interface represents a logger
+type Interface interface {
+	Print(v ...interface{})
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// Loggers used by the rest of the module, swappable by assigning to these
+// variables
+var (
+	DEBUG   Interface = log.New(ioutil.Discard, "DEBUG: ", log.LstdFlags)
+	INFO    Interface = log.New(os.Stdout, "INFO: ", log.LstdFlags)
+	WARNING Interface = log.New(os.Stdout, "WARNING: ", log.LstdFlags)
+	ERROR   Interface = log.New(os.Stderr, "ERROR: ", log.LstdFlags)
+	FATAL   Interface = log.New(os.Stderr, "FATAL: ", log.LstdFlags)
+)
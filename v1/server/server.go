@@ -0,0 +1,51 @@
+// Package server wires a broker up into the object applications interact
+// with to publish tasks and manage a running Machinery deployment
+package server
+
+import (
+	"context"
+
+	"github.com/RichardKnop/machinery/v1/brokers/iface"
+	"github.com/RichardKnop/machinery/v1/brokers/servicebus"
+	"github.com/RichardKnop/machinery/v1/brokers/servicebus/dlq"
+	"github.com/RichardKnop/machinery/v1/config"
+)
+
+// Server is the main Machinery object, holding config and the broker used
+// to publish and consume tasks
+type Server struct {
+	config *config.Config
+	broker iface.Broker
+}
+
+// NewServer creates a Server instance
+func NewServer(cnf *config.Config, broker iface.Broker) *Server {
+	return &Server{config: cnf, broker: broker}
+}
+
+// GetConfig returns the server config
+func (s *Server) GetConfig() *config.Config {
+	return s.config
+}
+
+// GetBroker returns the server's broker
+func (s *Server) GetBroker() iface.Broker {
+	return s.broker
+}
+
+// CancelTask asks whichever broker instance is currently processing
+// taskUUID to stop, by delegating to the broker's CancelTask
+// implementation
+func (s *Server) CancelTask(ctx context.Context, taskUUID string) error {
+	return s.broker.CancelTask(ctx, taskUUID)
+}
+
+// DLQManager returns a dlq.DLQManager for queueName when the server is
+// backed by the Service Bus broker, or nil otherwise
+func (s *Server) DLQManager(queueName string) (*dlq.DLQManager, error) {
+	sbBroker, ok := s.broker.(*servicebus.Broker)
+	if !ok {
+		return nil, nil
+	}
+	return sbBroker.DLQManager(queueName)
+}
@@ -0,0 +1,17 @@
+package tasks
+
+import "time"
+
+// Headers represents user defined task headers
+type Headers map[string]interface{}
+
+// Signature represents a single task invocation
+type Signature struct {
+	UUID                        string
+	Name                        string
+	RoutingKey                  string
+	GroupUUID                   string
+	ETA                         *time.Time
+	Headers                     Headers
+	IgnoreWhenTaskNotRegistered bool
+}